@@ -0,0 +1,26 @@
+// Package cache defines a small memcache-style lookup interface so callers
+// don't have to depend on google.golang.org/appengine/memcache directly.
+package cache
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrCacheMiss is returned by Get when no item is found for the given key.
+var ErrCacheMiss = errors.New("cache: miss")
+
+// Cache is a key/value store with expiring entries, modeled after
+// google.golang.org/appengine/memcache. Implementations must be safe for
+// concurrent use; whether an implementation bounds its size is up to it
+// (MemoryCache does not).
+type Cache interface {
+	// Get returns the value stored under key, or ErrCacheMiss if absent or
+	// expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key. A zero expiration means the entry never
+	// expires.
+	Set(ctx context.Context, key string, value []byte, expiration time.Duration) error
+}
@@ -0,0 +1,31 @@
+package cache
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// AppengineCache is the production Cache backed by the App Engine memcache
+// service.
+type AppengineCache struct{}
+
+func (AppengineCache) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := memcache.Get(ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+func (AppengineCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	return memcache.Set(ctx, &memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: expiration,
+	})
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type memoryItem struct {
+	value    []byte
+	deadline time.Time // zero means no expiration
+}
+
+// MemoryCache is a process-local Cache implementation with no external
+// dependencies, suitable for unit tests and local development.
+type MemoryCache struct {
+	mu    sync.Mutex
+	items map[string]memoryItem
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{items: make(map[string]memoryItem)}
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	if !item.deadline.IsZero() && item.deadline.Before(time.Now()) {
+		delete(c.items, key)
+		return nil, ErrCacheMiss
+	}
+	return item.value, nil
+}
+
+func (c *MemoryCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var deadline time.Time
+	if expiration > 0 {
+		deadline = time.Now().Add(expiration)
+	}
+	c.items[key] = memoryItem{value: value, deadline: deadline}
+	return nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"crypto/sha256"
+
+	"github.com/SSHZ-ORG/dedicatus/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// BackfillContentHashes walks every Inventory and fills in ContentHash for
+// any record still missing one (i.e. written before ContentHash existed),
+// by re-fetching the file from GCS and hashing it. It is meant to be driven
+// by a one-off cron/task handler rather than called on a request path, so
+// it logs and continues past per-GIF failures instead of aborting the whole
+// run.
+func BackfillContentHashes(ctx context.Context) error {
+	fileIDs, err := AllInventoriesFileIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, fileID := range fileIDs {
+		if err := backfillContentHash(ctx, fileID); err != nil {
+			log.Errorf(ctx, "BackfillContentHashes: %s: %v", fileID, err)
+		}
+	}
+	return nil
+}
+
+func backfillContentHash(ctx context.Context, fileID string) error {
+	i, err := GetInventory(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	if len(i.ContentHash) > 0 {
+		return nil
+	}
+
+	b, err := utils.FetchFileFromGCS(ctx, fileID)
+	if err != nil {
+		return err
+	}
+	contentHash := sha256.Sum256(b)
+
+	return store.RunInTransaction(ctx, func(ctx context.Context) error {
+		i := new(Inventory)
+		if err := store.Get(ctx, fileID, i); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				// Silently ignore this.
+				return nil
+			}
+			return err
+		}
+
+		i.ContentHash = contentHash[:]
+		if err := store.Put(ctx, fileID, i); err != nil {
+			return err
+		}
+		invalidateInventoryCache(fileID)
+		invalidateInventoryHashCache(i.FileSize, contentHash[:], nil)
+		return nil
+	}, &datastore.TransactionOptions{})
+}
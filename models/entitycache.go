@@ -0,0 +1,135 @@
+package models
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// EntityCache is a bounded, in-process LRU cache for hot Inventory and
+// Personality lookups, keyed by an opaque "<kind>:<index>:<key>" string (see
+// inventoryFileIDCacheKey and friends in inventory.go). It exists to spare
+// repeated single-entity round trips to Datastore/memcache on hot paths like
+// Inventory.ToString and FindInventories; GetMulti-backed callers batch
+// their misses into a single GetMulti call (Store.GetMulti for inventories,
+// nds.GetMulti for personalities) rather than looking up one entity at a
+// time.
+//
+// A cached Inventory is invalidated whenever this package's Inventory
+// writes Put or Delete it, so such an entry never outlives the Datastore
+// value it was read from except for writes from other instances, which is
+// bounded by negativeTTL for misses and is otherwise an accepted staleness
+// window for a process-local cache. Cached Personality entries are not
+// invalidated on write; they live until evicted.
+type EntityCache struct {
+	mu       sync.Mutex
+	capacity int
+	// negativeTTL bounds how long a "this key does not exist" result is
+	// trusted, to avoid a thundering herd of repeated lookups for a
+	// consistently-missing key without caching it forever.
+	negativeTTL time.Duration
+
+	ll    *list.List
+	items map[string]*list.Element
+
+	hits, misses int64
+}
+
+type cacheEntry struct {
+	key   string
+	value interface{} // nil means "confirmed absent" (a negative entry)
+
+	// expiresAt is only consulted for negative entries; positive entries
+	// live until evicted or explicitly invalidated.
+	expiresAt time.Time
+}
+
+func NewEntityCache(capacity int, negativeTTL time.Duration) *EntityCache {
+	return &EntityCache{
+		capacity:    capacity,
+		negativeTTL: negativeTTL,
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+	}
+}
+
+// get returns (value, true) on a cache hit, where value is nil if key is
+// known not to exist. It returns (nil, false) on a miss (including an
+// expired negative entry, which is treated as a miss).
+func (c *EntityCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if entry.value == nil && !entry.expiresAt.IsZero() && entry.expiresAt.Before(time.Now()) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.misses++
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.hits++
+	return entry.value, true
+}
+
+func (c *EntityCache) putPositive(key string, value interface{}) {
+	c.put(key, value, time.Time{})
+}
+
+func (c *EntityCache) putNegative(key string) {
+	c.put(key, nil, time.Now().Add(c.negativeTTL))
+}
+
+func (c *EntityCache) put(key string, value interface{}, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		el.Value.(*cacheEntry).value = value
+		el.Value.(*cacheEntry).expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&cacheEntry{key: key, value: value, expiresAt: expiresAt})
+	c.items[key] = el
+
+	if c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*cacheEntry).key)
+		}
+	}
+}
+
+func (c *EntityCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// Stats returns cumulative hit/miss counts, for exporting as metrics.
+func (c *EntityCache) Stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses
+}
+
+const entityCacheNegativeTTL = 30 * time.Second
+
+// entityCache backs the lookups in inventory.go. Tests may swap it out the
+// same way they swap store.
+var entityCache = NewEntityCache(1024, entityCacheNegativeTTL)
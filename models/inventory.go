@@ -2,9 +2,9 @@ package models
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
@@ -19,10 +19,43 @@ import (
 
 const maxItems = 50
 
+// fetchFileInfoTimeout bounds how long a single Telegram getFile round trip
+// (plus download) is allowed to take, so a stalled Telegram API call can't
+// hang a request indefinitely.
+const fetchFileInfoTimeout = 30 * time.Second
+
 var (
 	ErrorOnlyAdminCanUpdateInventory = errors.New("Only admins can update an existing GIF.")
 )
 
+// Order picks a browse mode for FindInventories.
+type Order int
+
+const (
+	// OrderByUsageCount lists the most-used inventories first. This is the
+	// historical default.
+	OrderByUsageCount Order = iota
+	// OrderByLastUsed lists the most recently used inventories first.
+	OrderByLastUsed
+	// OrderByRecent is an alias of OrderByLastUsed for callers that want a
+	// "recently seen" browse mode; both sort on the same LastUsed
+	// timestamp today.
+	OrderByRecent
+)
+
+// queryOrderBy returns the Datastore-style order keys for o, always ending
+// in "FileID" so ties (e.g. equal UsageCount) are broken deterministically
+// and Query cursors stay stable. FileID mirrors the entity key's string ID,
+// so this has the same effect as ordering on the key itself.
+func (o Order) queryOrderBy() []string {
+	switch o {
+	case OrderByLastUsed, OrderByRecent:
+		return []string{"-LastUsed", "FileID"}
+	default:
+		return []string{"-UsageCount", "FileID"}
+	}
+}
+
 type Inventory struct {
 	FileID      string
 	FileType    string
@@ -32,13 +65,15 @@ type Inventory struct {
 	UsageCount int64
 	LastUsed   time.Time
 
-	MD5Sum   datastore.ByteString
-	FileSize int
+	// MD5Sum is kept only for backward-compat lookups on records written
+	// before ContentHash existed; new dedup lookups use ContentHash.
+	MD5Sum      datastore.ByteString
+	ContentHash datastore.ByteString
+	FileSize    int
 }
 
 func (i Inventory) ToString(ctx context.Context) (string, error) {
-	ps := make([]*Personality, len(i.Personality))
-	err := nds.GetMulti(ctx, i.Personality, ps)
+	ps, err := getPersonalitiesCached(ctx, i.Personality)
 	if err != nil {
 		return "", err
 	}
@@ -55,15 +90,168 @@ func inventoryKey(ctx context.Context, fileID string) *datastore.Key {
 	return datastore.NewKey(ctx, inventoryEntityKind, fileID, 0, nil)
 }
 
+func inventoryFileIDCacheKey(fileID string) string {
+	return "Inventory:FileID:" + fileID
+}
+
+func personalityKeyCacheKey(key *datastore.Key) string {
+	return "Personality:Key:" + key.Encode()
+}
+
+func inventoryContentHashCacheKey(fileSize int, hash []byte) string {
+	return fmt.Sprintf("Inventory:ContentHash:%d:%x", fileSize, hash)
+}
+
+func inventoryMD5SumCacheKey(fileSize int, sum []byte) string {
+	return fmt.Sprintf("Inventory:MD5Sum:%d:%x", fileSize, sum)
+}
+
+// invalidateInventoryHashCache must be called after any write that changes
+// fileSize's ContentHash/MD5Sum (UpdateFileMetadata, the ContentHash
+// backfill), so a cached "no match for this hash" result from before the
+// write isn't served once a match exists.
+func invalidateInventoryHashCache(fileSize int, contentHash, md5Sum []byte) {
+	if len(contentHash) > 0 {
+		entityCache.invalidate(inventoryContentHashCacheKey(fileSize, contentHash))
+	}
+	if len(md5Sum) > 0 {
+		entityCache.invalidate(inventoryMD5SumCacheKey(fileSize, md5Sum))
+	}
+}
+
+// lookupInventoryIDByHash resolves the FileID of the single Inventory whose
+// FileSize and field (ContentHash or MD5Sum) equal fileSize and hash,
+// serving entityCache when possible so repeated GetInventoryByFile calls
+// for the same content (the common case) skip the Datastore round trip. A
+// conflict (more than one match) is logged and treated as "no match," same
+// as an uncached lookup, and is deliberately left out of the cache so it's
+// retried rather than pinned.
+func lookupInventoryIDByHash(ctx context.Context, cacheKey, field string, fileSize int, hash []byte) (string, error) {
+	if v, ok := entityCache.get(cacheKey); ok {
+		if v == nil {
+			return "", nil
+		}
+		return v.(string), nil
+	}
+
+	ids, _, err := store.Query(ctx, QuerySpec{Filters: []QueryFilter{
+		{Field: "FileSize", Value: fileSize},
+		{Field: field, Value: datastore.ByteString(hash)},
+	}})
+	if err != nil {
+		return "", err
+	}
+
+	if len(ids) > 1 {
+		log.Criticalf(ctx, "Hash conflict (%x)!", hash)
+		return "", nil
+	}
+	if len(ids) == 0 {
+		entityCache.putNegative(cacheKey)
+		return "", nil
+	}
+
+	entityCache.putPositive(cacheKey, ids[0])
+	return ids[0], nil
+}
+
+// getPersonalitiesCached resolves keys to Personality entities, serving
+// whatever it can from entityCache and batching the rest into a single
+// nds.GetMulti, preserving the input order.
+func getPersonalitiesCached(ctx context.Context, keys []*datastore.Key) ([]*Personality, error) {
+	ps := make([]*Personality, len(keys))
+
+	var missingKeys []*datastore.Key
+	var missingIdx []int
+	for idx, key := range keys {
+		if v, ok := entityCache.get(personalityKeyCacheKey(key)); ok {
+			if v != nil {
+				ps[idx] = v.(*Personality)
+			}
+			continue
+		}
+		missingKeys = append(missingKeys, key)
+		missingIdx = append(missingIdx, idx)
+	}
+
+	if len(missingKeys) > 0 {
+		fetched := make([]*Personality, len(missingKeys))
+		if err := nds.GetMulti(ctx, missingKeys, fetched); err != nil {
+			return nil, err
+		}
+		for i, idx := range missingIdx {
+			ps[idx] = fetched[i]
+			entityCache.putPositive(personalityKeyCacheKey(missingKeys[i]), fetched[i])
+		}
+	}
+
+	return ps, nil
+}
+
 func GetInventory(ctx context.Context, fileID string) (*Inventory, error) {
+	cacheKey := inventoryFileIDCacheKey(fileID)
+	if v, ok := entityCache.get(cacheKey); ok {
+		if v == nil {
+			return new(Inventory), datastore.ErrNoSuchEntity
+		}
+		return v.(*Inventory), nil
+	}
+
 	i := new(Inventory)
-	key := inventoryKey(ctx, fileID)
-	err := nds.Get(ctx, key, i)
-	return i, err
+	err := store.Get(ctx, fileID, i)
+	if err == datastore.ErrNoSuchEntity {
+		entityCache.putNegative(cacheKey)
+		return i, err
+	}
+	if err != nil {
+		return i, err
+	}
+	entityCache.putPositive(cacheKey, i)
+	return i, nil
+}
+
+// invalidateInventoryCache must be called after any Put or Delete of
+// fileID's Inventory so entityCache never serves a value this process just
+// wrote past.
+func invalidateInventoryCache(fileID string) {
+	entityCache.invalidate(inventoryFileIDCacheKey(fileID))
+}
+
+// getInventoriesCached resolves fileIDs to Inventory entities, serving
+// whatever it can from entityCache and batching the rest into a single
+// Store.GetMulti, preserving the input order.
+func getInventoriesCached(ctx context.Context, fileIDs []string) ([]*Inventory, error) {
+	inventories := make([]*Inventory, len(fileIDs))
+
+	var missingIDs []string
+	var missingIdx []int
+	for idx, fileID := range fileIDs {
+		if v, ok := entityCache.get(inventoryFileIDCacheKey(fileID)); ok {
+			if v != nil {
+				inventories[idx] = v.(*Inventory)
+			}
+			continue
+		}
+		missingIDs = append(missingIDs, fileID)
+		missingIdx = append(missingIdx, idx)
+	}
+
+	if len(missingIDs) > 0 {
+		fetched := make([]*Inventory, len(missingIDs))
+		if err := store.GetMulti(ctx, missingIDs, fetched); err != nil {
+			return nil, err
+		}
+		for i, idx := range missingIdx {
+			inventories[idx] = fetched[i]
+			entityCache.putPositive(inventoryFileIDCacheKey(missingIDs[i]), fetched[i])
+		}
+	}
+
+	return inventories, nil
 }
 
 func GetInventoryByFile(ctx context.Context, fileID string, fileSize int) (*Inventory, error) {
-	count, err := datastore.NewQuery(inventoryEntityKind).Filter("FileSize =", fileSize).Count(ctx)
+	count, err := store.Count(ctx, QuerySpec{Filters: []QueryFilter{{Field: "FileSize", Value: fileSize}}})
 	if err != nil {
 		return nil, err
 	}
@@ -71,30 +259,38 @@ func GetInventoryByFile(ctx context.Context, fileID string, fileSize int) (*Inve
 		return nil, nil
 	}
 
-	_, b, err := tgapi.FetchFileInfo(ctx, fileID)
-	s := md5.Sum(b)
+	fetchCtx, cancel := context.WithTimeout(ctx, fetchFileInfoTimeout)
+	defer cancel()
+	_, b, err := tgapi.FetchFileInfo(fetchCtx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	contentHash := sha256.Sum256(b)
 
-	keys, err := datastore.NewQuery(inventoryEntityKind).Filter("MD5Sum =", s[:]).KeysOnly().GetAll(ctx, nil)
+	id, err := lookupInventoryIDByHash(ctx, inventoryContentHashCacheKey(fileSize, contentHash[:]), "ContentHash", fileSize, contentHash[:])
 	if err != nil {
 		return nil, err
 	}
 
-	if len(keys) == 0 {
-		return nil, nil
-	} else if len(keys) > 1 {
-		log.Criticalf(ctx, "Hash conflict (%x)!", s)
+	if id == "" {
+		// Fall back to MD5 for records ingested before ContentHash existed.
+		sum := md5.Sum(b)
+		id, err = lookupInventoryIDByHash(ctx, inventoryMD5SumCacheKey(fileSize, sum[:]), "MD5Sum", fileSize, sum[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if id == "" {
 		return nil, nil
 	}
 
-	i := new(Inventory)
-	err = nds.Get(ctx, keys[0], i)
-	return i, err
+	return GetInventory(ctx, id)
 }
 
 func CreateInventory(ctx context.Context, fileID string, personality []*datastore.Key, userID int, config Config) (*Inventory, error) {
 	i := new(Inventory)
-	key := inventoryKey(ctx, fileID)
-	err := nds.Get(ctx, key, i)
+	err := store.Get(ctx, fileID, i)
 
 	// This is an existing Inventory, only admins or original creator can update it.
 	if err == nil && !(config.IsAdmin(userID) || i.Creator == userID) {
@@ -113,129 +309,108 @@ func CreateInventory(ctx context.Context, fileID string, personality []*datastor
 		i.Creator = userID
 	}
 
-	_, err = nds.Put(ctx, key, i)
-	return i, err
+	if err = store.Put(ctx, fileID, i); err != nil {
+		return nil, err
+	}
+	invalidateInventoryCache(fileID)
+	return i, nil
 }
 
-func FindInventories(ctx context.Context, personalities []*datastore.Key, lastCursor string) ([]*Inventory, string, error) {
-	q := datastore.NewQuery(inventoryEntityKind).KeysOnly()
-
+// FindInventories returns up to maxItems inventories matching personalities,
+// in the given browse order. Pass "" as lastCursor for the first page, and
+// thread the returned cursor back in to fetch the next one; an empty
+// returned cursor means there are no more pages.
+func FindInventories(ctx context.Context, personalities []*datastore.Key, order Order, lastCursor string) ([]*Inventory, string, error) {
+	spec := QuerySpec{OrderBy: order.queryOrderBy(), Limit: maxItems, Cursor: lastCursor}
 	for _, personality := range personalities {
-		q = q.Filter("Personality = ", personality)
+		spec.Filters = append(spec.Filters, QueryFilter{Field: "Personality", Value: personality})
 	}
 
-	q = q.Order("-UsageCount").Limit(maxItems)
-
-	offset, err := strconv.Atoi(lastCursor)
-	if err != nil {
-		q = q.Offset(offset)
-	}
-
-	keys, err := q.GetAll(ctx, nil)
+	ids, newCursor, err := store.Query(ctx, spec)
 	if err != nil {
 		return nil, "", err
 	}
 
-	if len(keys) == 0 {
+	if len(ids) == 0 {
 		return nil, "", nil
 	}
 
-	inventories := make([]*Inventory, len(keys))
-	err = nds.GetMulti(ctx, keys, inventories)
+	inventories, err := getInventoriesCached(ctx, ids)
 	if err != nil {
 		return nil, "", err
 	}
 
-	newCursor := ""
-	if len(keys) == maxItems {
-		newCursor = strconv.Itoa(offset + maxItems)
-	}
-
 	return inventories, newCursor, nil
 }
 
 func GloballyLastUsedInventories(ctx context.Context) ([]*Inventory, error) {
-	keys, err := datastore.NewQuery(inventoryEntityKind).KeysOnly().Order("-LastUsed").Limit(maxItems).GetAll(ctx, nil)
+	ids, _, err := store.Query(ctx, QuerySpec{OrderBy: OrderByLastUsed.queryOrderBy(), Limit: maxItems})
 	if err != nil {
 		return nil, err
 	}
 
-	if len(keys) == 0 {
+	if len(ids) == 0 {
 		return nil, nil
 	}
 
-	inventories := make([]*Inventory, len(keys))
-	err = nds.GetMulti(ctx, keys, inventories)
-	return inventories, err
+	return getInventoriesCached(ctx, ids)
 }
 
 func AllInventoriesFileIDs(ctx context.Context) ([]string, error) {
-	keys, err := datastore.NewQuery(inventoryEntityKind).KeysOnly().GetAll(ctx, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	var fileIDs []string
-	for _, k := range keys {
-		fileIDs = append(fileIDs, k.StringID())
-	}
-
-	return fileIDs, nil
+	ids, _, err := store.Query(ctx, QuerySpec{})
+	return ids, err
 }
 
+// IncrementUsageCounter records a single use of fileID. Increments are
+// coalesced through usageBatcher rather than written to Datastore inline, so
+// a burst of repeat uses of the same GIF costs one transaction instead of
+// one per call.
 func IncrementUsageCounter(ctx context.Context, fileID string) error {
-	return nds.RunInTransaction(ctx, func(ctx context.Context) error {
-		i := new(Inventory)
-		key := inventoryKey(ctx, fileID)
-		if err := nds.Get(ctx, key, i); err != nil {
-			if err == datastore.ErrNoSuchEntity {
-				// Silently ignore this.
-				return nil
-			}
-			return err
-		}
-
-		i.UsageCount += 1
-		i.LastUsed = time.Now()
-
-		_, err := nds.Put(ctx, key, i)
-		return err
-	}, &datastore.TransactionOptions{})
+	usageBatcher.Incr(fileID)
+	return nil
 }
 
 func CountInventories(ctx context.Context, personality *datastore.Key) (int, error) {
-	return datastore.NewQuery(inventoryEntityKind).KeysOnly().Filter("Personality = ", personality).Count(ctx)
+	return store.Count(ctx, QuerySpec{Filters: []QueryFilter{{Field: "Personality", Value: personality}}})
 }
 
 func ReplaceFileID(ctx context.Context, oldFileID, newFileID string) (*Inventory, error) {
 	i := new(Inventory)
 
-	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
-		oldKey := inventoryKey(ctx, oldFileID)
-		if err := nds.Get(ctx, oldKey, i); err != nil {
+	err := store.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := store.Get(ctx, oldFileID, i); err != nil {
 			return err
 		}
+		fileSize, contentHash, md5Sum := i.FileSize, i.ContentHash, i.MD5Sum
 
 		i.FileID = newFileID
 
-		if err := nds.Delete(ctx, oldKey); err != nil {
+		if err := store.Delete(ctx, oldFileID); err != nil {
 			return err
 		}
-		_, err := nds.Put(ctx, inventoryKey(ctx, newFileID), i)
-		return err
+		invalidateInventoryCache(oldFileID)
+
+		if err := store.Put(ctx, newFileID, i); err != nil {
+			return err
+		}
+		invalidateInventoryCache(newFileID)
+		invalidateInventoryHashCache(fileSize, contentHash, md5Sum)
+		return nil
 	}, &datastore.TransactionOptions{XG: true})
 
 	return i, err
 }
 
 func UpdateFileMetadata(ctx context.Context, oldFileID string) error {
-	file, b, err := tgapi.FetchFileInfo(ctx, oldFileID)
+	fetchCtx, cancel := context.WithTimeout(ctx, fetchFileInfoTimeout)
+	defer cancel()
+	file, b, err := tgapi.FetchFileInfo(fetchCtx, oldFileID)
 	if err != nil {
 		return err
 	}
 
 	newFileID := file.FileID
-	if (newFileID != oldFileID) {
+	if newFileID != oldFileID {
 		log.Infof(ctx, "Detected FileID change %s -> %s", oldFileID, newFileID)
 	}
 
@@ -246,12 +421,12 @@ func UpdateFileMetadata(ctx context.Context, oldFileID string) error {
 	}
 
 	sum := md5.Sum(b)
-	log.Infof(ctx, "File %s: %x (%d bytes)", newFileID, sum, file.FileSize)
+	contentHash := sha256.Sum256(b)
+	log.Infof(ctx, "File %s: %x (%d bytes)", newFileID, contentHash, file.FileSize)
 
-	return nds.RunInTransaction(ctx, func(tc context.Context) error {
+	return store.RunInTransaction(ctx, func(ctx context.Context) error {
 		i := new(Inventory)
-		oldKey := inventoryKey(ctx, oldFileID)
-		if err := nds.Get(ctx, oldKey, i); err != nil {
+		if err := store.Get(ctx, oldFileID, i); err != nil {
 			if err == datastore.ErrNoSuchEntity {
 				// Silently ignore this.
 				return nil
@@ -261,14 +436,21 @@ func UpdateFileMetadata(ctx context.Context, oldFileID string) error {
 
 		i.FileID = newFileID
 		i.MD5Sum = sum[:]
+		i.ContentHash = contentHash[:]
 		i.FileSize = file.FileSize
 
 		if oldFileID != newFileID {
-			if err := nds.Delete(ctx, oldKey); err != nil {
+			if err := store.Delete(ctx, oldFileID); err != nil {
 				return err
 			}
+			invalidateInventoryCache(oldFileID)
 		}
-		_, err := nds.Put(ctx, inventoryKey(ctx, newFileID), i)
-		return err
+
+		if err := store.Put(ctx, newFileID, i); err != nil {
+			return err
+		}
+		invalidateInventoryCache(newFileID)
+		invalidateInventoryHashCache(file.FileSize, contentHash[:], sum[:])
+		return nil
 	}, &datastore.TransactionOptions{})
 }
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type fakeConfig struct{}
+
+func (fakeConfig) IsAdmin(userID int) bool { return false }
+
+// useInMemoryStore swaps the package-level store for a fresh InMemoryStore,
+// and entityCache for a fresh EntityCache, for the duration of a test. Both
+// are reset together because entityCache can otherwise serve a *Inventory
+// left over from a previous test's store instead of this test's.
+func useInMemoryStore(t *testing.T) *InMemoryStore {
+	t.Helper()
+
+	oldStore := store
+	ms := NewInMemoryStore()
+	store = ms
+	t.Cleanup(func() { store = oldStore })
+
+	oldCache := entityCache
+	entityCache = NewEntityCache(1024, entityCacheNegativeTTL)
+	t.Cleanup(func() { entityCache = oldCache })
+
+	return ms
+}
+
+func TestFindInventoriesCursorStableAcrossInserts(t *testing.T) {
+	ms := useInMemoryStore(t)
+	ctx := context.Background()
+	personality := new(datastore.Key)
+
+	// Seed more than one page's worth of inventories with distinct
+	// UsageCount so ordering (and the resulting cursor) is deterministic.
+	for i := 0; i < maxItems+2; i++ {
+		fileID := fmt.Sprintf("seed-%d", i)
+		if _, err := CreateInventory(ctx, fileID, []*datastore.Key{personality}, 1, fakeConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		inv, err := GetInventory(ctx, fileID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inv.UsageCount = int64(maxItems + 2 - i) // seed-0 highest, last one lowest
+		if err := ms.Put(ctx, fileID, inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page1, cursor, err := FindInventories(ctx, []*datastore.Key{personality}, OrderByUsageCount, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page1) != maxItems {
+		t.Fatalf("want a full page of %d, got %d", maxItems, len(page1))
+	}
+	if cursor == "" {
+		t.Fatal("want a non-empty cursor for a full page")
+	}
+	if page1[0].FileID != "seed-0" {
+		t.Fatalf("want seed-0 first (highest UsageCount), got %s", page1[0].FileID)
+	}
+
+	// Insert a new inventory that sorts ahead of everything already
+	// returned. A naive offset-based cursor would shift the next page by
+	// one and skip or repeat an entry; a real cursor must not be affected.
+	if _, err := CreateInventory(ctx, "inserted", []*datastore.Key{personality}, 1, fakeConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	inserted, err := GetInventory(ctx, "inserted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inserted.UsageCount = int64(maxItems + 100)
+	if err := ms.Put(ctx, "inserted", inserted); err != nil {
+		t.Fatal(err)
+	}
+
+	page2, _, err := FindInventories(ctx, []*datastore.Key{personality}, OrderByUsageCount, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page2) != 2 {
+		t.Fatalf("want the remaining 2 entries, got %d", len(page2))
+	}
+	if page2[0].FileID != fmt.Sprintf("seed-%d", maxItems) || page2[1].FileID != fmt.Sprintf("seed-%d", maxItems+1) {
+		t.Fatalf("page2 was disrupted by an insert ahead of the cursor: %+v", page2)
+	}
+}
@@ -0,0 +1,220 @@
+package models
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// InMemoryStore is a pure Go, non-persistent Store implementation suitable
+// for unit tests and local development without App Engine. It keeps decoded
+// entity values in memory and evaluates QuerySpecs by reflecting over
+// struct fields, so it only needs to understand the shapes used by this
+// package (Inventory today).
+type InMemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]interface{}
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{entries: make(map[string]interface{})}
+}
+
+func (s *InMemoryStore) Get(ctx context.Context, id string, dst interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.entries[id]
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(v).Elem())
+	return nil
+}
+
+// GetMulti fills dst, a []*S of pre-allocated or nil pointers, matching the
+// calling convention of nds.GetMulti/datastore.GetMulti.
+func (s *InMemoryStore) GetMulti(ctx context.Context, ids []string, dst interface{}) error {
+	dv := reflect.ValueOf(dst)
+	for idx, id := range ids {
+		elem := dv.Index(idx)
+		if elem.IsNil() {
+			elem.Set(reflect.New(elem.Type().Elem()))
+		}
+		if err := s.Get(ctx, id, elem.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStore) Put(ctx context.Context, id string, src interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cp := reflect.New(reflect.ValueOf(src).Elem().Type())
+	cp.Elem().Set(reflect.ValueOf(src).Elem())
+	s.entries[id] = cp.Interface()
+	return nil
+}
+
+func (s *InMemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, id)
+	return nil
+}
+
+// fieldMatches reports whether entity satisfies the single equality filter.
+// Array-valued fields are matched by membership, matching Datastore's
+// semantics for equality filters on repeated properties.
+func fieldMatches(entity reflect.Value, filter QueryFilter) bool {
+	field := entity.FieldByName(filter.Field)
+	if !field.IsValid() {
+		return false
+	}
+	want := reflect.ValueOf(filter.Value)
+
+	if field.Kind() == reflect.Slice {
+		// Byte slices (e.g. datastore.ByteString) are matched as a whole,
+		// like any other scalar; other slices use Datastore's membership
+		// semantics for equality filters on repeated properties.
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			return bytes.Equal(field.Bytes(), want.Bytes())
+		}
+		for i := 0; i < field.Len(); i++ {
+			if valuesEqual(field.Index(i), want) {
+				return true
+			}
+		}
+		return false
+	}
+	return valuesEqual(field, want)
+}
+
+// valuesEqual compares two reflect.Values the way Datastore would: by
+// *datastore.Key.Equal for keys (two independently-constructed keys with
+// the same kind/StringID are the same key, even though they're different
+// pointers), and by == otherwise.
+func valuesEqual(a, b reflect.Value) bool {
+	if ak, ok := a.Interface().(*datastore.Key); ok {
+		bk, ok := b.Interface().(*datastore.Key)
+		return ok && ak.Equal(bk)
+	}
+	return a.Interface() == b.Interface()
+}
+
+// matchingIDsOrdered returns every entity ID matching spec.Filters, sorted
+// by spec.OrderBy (unfiltered by spec.Cursor/Limit, which Query applies
+// afterwards so that paging is stable against concurrent inserts).
+func (s *InMemoryStore) matchingIDsOrdered(spec QuerySpec) []string {
+	var ids []string
+	for id, v := range s.entries {
+		entity := reflect.ValueOf(v).Elem()
+		ok := true
+		for _, f := range spec.Filters {
+			if !fieldMatches(entity, f) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return s.orderLess(ids[i], ids[j], spec.OrderBy)
+	})
+	return ids
+}
+
+// orderLess compares two entity IDs by each OrderBy key in turn ("-field"
+// for descending), falling back to comparing the IDs themselves so the
+// order is always fully deterministic.
+func (s *InMemoryStore) orderLess(idI, idJ string, orderBy []string) bool {
+	for _, o := range orderBy {
+		desc := false
+		field := o
+		if field[0] == '-' {
+			desc = true
+			field = field[1:]
+		}
+
+		vi := reflect.ValueOf(s.entries[idI]).Elem().FieldByName(field)
+		vj := reflect.ValueOf(s.entries[idJ]).Elem().FieldByName(field)
+		if vi.Interface() == vj.Interface() {
+			continue
+		}
+		less := lessValue(vi, vj)
+		if desc {
+			return !less
+		}
+		return less
+	}
+	return idI < idJ
+}
+
+func lessValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.String:
+		return a.String() < b.String()
+	default:
+		// time.Time and anything else exposing UnixNano.
+		at, aok := a.Interface().(interface{ UnixNano() int64 })
+		bt, bok := b.Interface().(interface{ UnixNano() int64 })
+		if aok && bok {
+			return at.UnixNano() < bt.UnixNano()
+		}
+		return false
+	}
+}
+
+func (s *InMemoryStore) Query(ctx context.Context, spec QuerySpec) ([]string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matches := s.matchingIDsOrdered(spec)
+
+	start := 0
+	if spec.Cursor != "" {
+		for idx, id := range matches {
+			if id == spec.Cursor {
+				start = idx + 1
+				break
+			}
+		}
+	}
+	page := matches[start:]
+
+	if spec.Limit > 0 && spec.Limit < len(page) {
+		page = page[:spec.Limit]
+	}
+
+	nextCursor := ""
+	if spec.Limit > 0 && len(page) == spec.Limit {
+		nextCursor = page[len(page)-1]
+	}
+	return page, nextCursor, nil
+}
+
+func (s *InMemoryStore) Count(ctx context.Context, spec QuerySpec) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.matchingIDsOrdered(spec)), nil
+}
+
+// RunInTransaction simply invokes f with the same ctx: individual Get/Put
+// calls already serialize on s.mu, which is sufficient for a test fake.
+func (s *InMemoryStore) RunInTransaction(ctx context.Context, f func(ctx context.Context) error, opts *datastore.TransactionOptions) error {
+	return f(ctx)
+}
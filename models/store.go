@@ -0,0 +1,136 @@
+package models
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+// QueryFilter is a single equality filter applied to a Store query, e.g.
+// {Field: "Personality", Value: personalityKey}.
+type QueryFilter struct {
+	Field string
+	Value interface{}
+}
+
+// QuerySpec describes a query against a single Inventory-shaped kind,
+// independent of any particular Store implementation.
+type QuerySpec struct {
+	Filters []QueryFilter
+	// OrderBy is a list of Datastore-style order strings (e.g.
+	// "-UsageCount") applied in priority order. Include a final
+	// unique field (FindInventories always appends "FileID") so ties
+	// are broken deterministically and cursors remain stable.
+	OrderBy []string
+	Limit   int
+	// Cursor resumes a previous Query from just after the entity it was
+	// returned for, rather than by a (re-scanned) numeric offset.
+	Cursor string
+}
+
+// Store abstracts the Datastore operations the Inventory model needs, keyed
+// by string entity IDs, so that callers (and tests) aren't forced to depend
+// on google.golang.org/appengine/datastore directly. The production
+// implementation is ndsStore; InMemoryStore is a pure Go fake for tests.
+type Store interface {
+	Get(ctx context.Context, id string, dst interface{}) error
+	// GetMulti fills dst, a []*S of pre-allocated or nil pointers, one per
+	// id, mirroring the calling convention of nds.GetMulti.
+	GetMulti(ctx context.Context, ids []string, dst interface{}) error
+	Put(ctx context.Context, id string, src interface{}) error
+	Delete(ctx context.Context, id string) error
+	// Query returns the IDs of entities matching spec, plus a cursor to
+	// resume after them if spec.Limit was reached (empty otherwise).
+	Query(ctx context.Context, spec QuerySpec) (ids []string, nextCursor string, err error)
+	Count(ctx context.Context, spec QuerySpec) (int, error)
+	RunInTransaction(ctx context.Context, f func(ctx context.Context) error, opts *datastore.TransactionOptions) error
+}
+
+// ndsStore is the production Store, backed by Datastore via qedus/nds (which
+// transparently layers memcache on top of Datastore).
+type ndsStore struct{}
+
+// store is the Store used by this package's exported functions. Tests may
+// swap it for an InMemoryStore.
+var store Store = ndsStore{}
+
+func (ndsStore) Get(ctx context.Context, id string, dst interface{}) error {
+	return nds.Get(ctx, inventoryKey(ctx, id), dst)
+}
+
+func (ndsStore) GetMulti(ctx context.Context, ids []string, dst interface{}) error {
+	keys := make([]*datastore.Key, len(ids))
+	for idx, id := range ids {
+		keys[idx] = inventoryKey(ctx, id)
+	}
+	return nds.GetMulti(ctx, keys, dst)
+}
+
+func (ndsStore) Put(ctx context.Context, id string, src interface{}) error {
+	_, err := nds.Put(ctx, inventoryKey(ctx, id), src)
+	return err
+}
+
+func (ndsStore) Delete(ctx context.Context, id string) error {
+	return nds.Delete(ctx, inventoryKey(ctx, id))
+}
+
+func (ndsStore) buildQuery(spec QuerySpec, keysOnly bool) *datastore.Query {
+	q := datastore.NewQuery(inventoryEntityKind)
+	if keysOnly {
+		q = q.KeysOnly()
+	}
+	for _, f := range spec.Filters {
+		q = q.Filter(f.Field+" =", f.Value)
+	}
+	for _, o := range spec.OrderBy {
+		q = q.Order(o)
+	}
+	if spec.Limit > 0 {
+		q = q.Limit(spec.Limit)
+	}
+	return q
+}
+
+func (s ndsStore) Query(ctx context.Context, spec QuerySpec) ([]string, string, error) {
+	q := s.buildQuery(spec, true)
+	if spec.Cursor != "" {
+		cur, err := datastore.DecodeCursor(spec.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(cur)
+	}
+
+	it := q.Run(ctx)
+	var ids []string
+	for {
+		k, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		ids = append(ids, k.StringID())
+	}
+
+	nextCursor := ""
+	if spec.Limit > 0 && len(ids) == spec.Limit {
+		cur, err := it.Cursor()
+		if err != nil {
+			return nil, "", err
+		}
+		nextCursor = cur.String()
+	}
+	return ids, nextCursor, nil
+}
+
+func (s ndsStore) Count(ctx context.Context, spec QuerySpec) (int, error) {
+	return s.buildQuery(spec, true).Count(ctx)
+}
+
+func (ndsStore) RunInTransaction(ctx context.Context, f func(ctx context.Context) error, opts *datastore.TransactionOptions) error {
+	return nds.RunInTransaction(ctx, f, opts)
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// UsageBatcher coalesces repeated IncrementUsageCounter-style increments for
+// the same FileID in memory, flushing them as a single transaction per key
+// on a timer (or as soon as the buffer reaches size), instead of opening a
+// Datastore transaction for every inline query result.
+type UsageBatcher struct {
+	mu      sync.Mutex
+	pending map[string]int64
+	size    int
+	bgCtx   context.Context
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewUsageBatcher starts a background flush loop on ctx and returns a
+// batcher that flushes automatically every flushInterval, or immediately
+// once size distinct FileIDs are pending.
+func NewUsageBatcher(ctx context.Context, size int, flushInterval time.Duration) *UsageBatcher {
+	b := &UsageBatcher{
+		pending: make(map[string]int64),
+		size:    size,
+		bgCtx:   ctx,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go b.run(flushInterval)
+	return b
+}
+
+func (b *UsageBatcher) run(flushInterval time.Duration) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(b.bgCtx); err != nil {
+				log.Errorf(b.bgCtx, "UsageBatcher: periodic flush: %v", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Incr records a single use of fileID to be coalesced into a later Flush.
+// If this brings the buffer up to its configured size, a flush is triggered
+// immediately in the background.
+func (b *UsageBatcher) Incr(fileID string) {
+	b.mu.Lock()
+	b.pending[fileID]++
+	full := len(b.pending) >= b.size
+	b.mu.Unlock()
+
+	if full {
+		go func() {
+			if err := b.Flush(b.bgCtx); err != nil {
+				log.Errorf(b.bgCtx, "UsageBatcher: size-triggered flush: %v", err)
+			}
+		}()
+	}
+}
+
+// Flush writes every pending increment to Datastore, one transaction per
+// FileID, setting LastUsed to the flush time, and clears the buffer.
+// FileIDs that fail to flush are put back so a later Flush retries them; a
+// single failure does not stop the rest of the batch from being attempted.
+func (b *UsageBatcher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]int64)
+	b.mu.Unlock()
+
+	now := time.Now()
+	var failed map[string]int64
+	var firstErr error
+	for fileID, delta := range pending {
+		err := store.RunInTransaction(ctx, func(ctx context.Context) error {
+			i := new(Inventory)
+			if err := store.Get(ctx, fileID, i); err != nil {
+				if err == datastore.ErrNoSuchEntity {
+					// Silently ignore this.
+					return nil
+				}
+				return err
+			}
+
+			i.UsageCount += delta
+			i.LastUsed = now
+
+			if err := store.Put(ctx, fileID, i); err != nil {
+				return err
+			}
+			invalidateInventoryCache(fileID)
+			return nil
+		}, &datastore.TransactionOptions{})
+
+		if err != nil {
+			if failed == nil {
+				failed = make(map[string]int64)
+			}
+			failed[fileID] = delta
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		b.mu.Lock()
+		for fileID, delta := range failed {
+			b.pending[fileID] += delta
+		}
+		b.mu.Unlock()
+	}
+	return firstErr
+}
+
+// Stop halts the background flush loop and drains any pending increments,
+// for use during graceful shutdown.
+func (b *UsageBatcher) Stop(ctx context.Context) error {
+	close(b.stop)
+	<-b.done
+	return b.Flush(ctx)
+}
+
+// usageBatcherSize is how many distinct FileIDs IncrementUsageCounter
+// buffers before flushing immediately, instead of waiting out
+// usageBatcherFlushInterval.
+const usageBatcherSize = 50
+
+// usageBatcherFlushInterval bounds how long a pending increment can sit
+// unflushed if the buffer never reaches usageBatcherSize distinct FileIDs.
+const usageBatcherFlushInterval = time.Minute
+
+// usageBatcher backs IncrementUsageCounter, coalescing repeated increments
+// for the same FileID into a single transaction instead of opening one per
+// call. Tests may swap it out the same way they swap store and entityCache.
+var usageBatcher = NewUsageBatcher(context.Background(), usageBatcherSize, usageBatcherFlushInterval)
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestUsageBatcherIncrFlush(t *testing.T) {
+	useInMemoryStore(t)
+	ctx := context.Background()
+	personality := new(datastore.Key)
+
+	for _, fileID := range []string{"a", "b"} {
+		if _, err := CreateInventory(ctx, fileID, []*datastore.Key{personality}, 1, fakeConfig{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A long flushInterval so only Flush (not the background timer) applies
+	// these increments within the test.
+	b := NewUsageBatcher(ctx, 1000, time.Hour)
+	defer b.Stop(ctx)
+
+	b.Incr("a")
+	b.Incr("a")
+	b.Incr("b")
+
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := GetInventory(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.UsageCount != 2 {
+		t.Fatalf("want a.UsageCount == 2, got %d", a.UsageCount)
+	}
+
+	bInv, err := GetInventory(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bInv.UsageCount != 1 {
+		t.Fatalf("want b.UsageCount == 1, got %d", bInv.UsageCount)
+	}
+}
+
+// failingOnceStore fails every Put for failOn the first time it's called,
+// then succeeds, so a test can force exactly one Flush to partially fail.
+type failingOnceStore struct {
+	*InMemoryStore
+	failOn string
+	failed bool
+}
+
+func (f *failingOnceStore) Put(ctx context.Context, id string, src interface{}) error {
+	if id == f.failOn && !f.failed {
+		f.failed = true
+		return errors.New("forced failure")
+	}
+	return f.InMemoryStore.Put(ctx, id, src)
+}
+
+func TestUsageBatcherFlushRetriesFailedIncrementsWithoutDroppingSiblings(t *testing.T) {
+	ms := useInMemoryStore(t)
+	ctx := context.Background()
+	personality := new(datastore.Key)
+
+	for _, fileID := range []string{"a", "b", "c"} {
+		if _, err := CreateInventory(ctx, fileID, []*datastore.Key{personality}, 1, fakeConfig{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := &failingOnceStore{InMemoryStore: ms, failOn: "b"}
+	store = fs
+
+	b := NewUsageBatcher(ctx, 1000, time.Hour)
+	defer b.Stop(ctx)
+
+	b.Incr("a")
+	b.Incr("b")
+	b.Incr("c")
+
+	if err := b.Flush(ctx); err == nil {
+		t.Fatal("want an error from the forced failure")
+	}
+
+	a, err := GetInventory(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.UsageCount != 1 {
+		t.Fatalf("sibling increment for a was dropped instead of flushed, got UsageCount=%d", a.UsageCount)
+	}
+	c, err := GetInventory(ctx, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UsageCount != 1 {
+		t.Fatalf("sibling increment for c was dropped instead of flushed, got UsageCount=%d", c.UsageCount)
+	}
+
+	// b's increment should have been requeued, and succeed on a retry.
+	if err := b.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bInv, err := GetInventory(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bInv.UsageCount != 1 {
+		t.Fatalf("want b's increment to be retried and applied, got UsageCount=%d", bInv.UsageCount)
+	}
+}
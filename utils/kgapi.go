@@ -5,18 +5,28 @@ import (
 	"strings"
 	"time"
 
+	"github.com/SSHZ-ORG/dedicatus/cache"
 	"github.com/SSHZ-ORG/dedicatus/config"
 	"golang.org/x/net/context"
 	"google.golang.org/api/kgsearch/v1"
 	"google.golang.org/api/option"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 )
 
 const kgMemcacheKey = "KG1:"
 
+// kgCache backs TryFindKGEntity's memoization. Swappable in tests.
+var kgCache cache.Cache = cache.AppengineCache{}
+
+// kgRequestTimeout bounds a single Knowledge Graph Search API call so a slow
+// or hanging upstream request can't stall the caller indefinitely.
+const kgRequestTimeout = 10 * time.Second
+
 // this returns the `result` node of the found entity.
 func sendKGEntityQuery(ctx context.Context, query string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, kgRequestTimeout)
+	defer cancel()
+
 	s, err := kgsearch.NewService(ctx, option.WithAPIKey(config.KGAPIKey))
 	if err != nil {
 		return nil, err
@@ -50,20 +60,16 @@ func getKGMemcacheKey(query string) string {
 }
 
 func getKGMemcache(ctx context.Context, query string) *string {
-	item, err := memcache.Get(ctx, getKGMemcacheKey(query))
+	value, err := kgCache.Get(ctx, getKGMemcacheKey(query))
 	if err == nil {
-		s := string(item.Value)
+		s := string(value)
 		return &s
 	}
 	return nil
 }
 
 func setKGMemcache(ctx context.Context, query, result string) {
-	_ = memcache.Set(ctx, &memcache.Item{
-		Key:        getKGMemcacheKey(query),
-		Value:      []byte(result),
-		Expiration: 4 * time.Hour,
-	})
+	_ = kgCache.Set(ctx, getKGMemcacheKey(query), []byte(result), 4*time.Hour)
 }
 
 func TryFindKGEntity(ctx context.Context, query string) string {